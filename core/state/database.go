@@ -0,0 +1,37 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+)
+
+// StateReader is the interface IntraBlockState uses to pull account, code and
+// storage data out of whatever is backing it. TrieDbState is the canonical
+// full-node implementation, but anything able to answer these four questions
+// (including a remote/ODR-backed light client) can stand in for it.
+//
+// This is deliberately narrower than upstream's state.Database: there is no
+// OpenTrie/OpenStorageTrie/ContractCode/ContractCodeSize/TrieDB surface here,
+// since nothing in this package needs to hand out a raw trie to its callers.
+type StateReader interface {
+	ReadAccountData(address common.Address) (*accounts.Account, error)
+	ReadAccountStorage(address common.Address, incarnation uint64, key *common.Hash) ([]byte, error)
+	ReadAccountCode(address common.Address, incarnation uint64, codeHash common.Hash) ([]byte, error)
+	ReadAccountCodeSize(address common.Address, incarnation uint64, codeHash common.Hash) (int, error)
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/ethdb"
+)
+
+// DumpAccount is the JSON-friendly representation of a single account as
+// produced by Dumper.
+type DumpAccount struct {
+	Balance  string            `json:"balance"`
+	Nonce    uint64            `json:"nonce"`
+	Root     string            `json:"root"`
+	CodeHash string            `json:"codeHash"`
+	Code     string            `json:"code,omitempty"`
+	Storage  map[string]string `json:"storage,omitempty"`
+}
+
+// Dump is the full world state as returned by DefaultDump.
+type Dump struct {
+	Root     string                 `json:"root"`
+	Accounts map[string]DumpAccount `json:"accounts"`
+}
+
+// IteratorDump is one page of the world state, as returned by RawDump. Next
+// is the cursor to pass as DumpConfig.Start to fetch the following page, and
+// is nil once the final page has been reached. Err is set if the underlying
+// database failed partway through the walk; Accounts then holds whatever was
+// read before the failure.
+type IteratorDump struct {
+	Root     string                 `json:"root"`
+	Accounts map[string]DumpAccount `json:"accounts"`
+	Next     []byte                 `json:"next,omitempty"`
+	Err      error                  `json:"-"`
+}
+
+// DumpConfig controls what a Dumper walk includes and where it starts/stops.
+type DumpConfig struct {
+	SkipCode          bool
+	SkipStorage       bool
+	OnlyWithAddresses bool
+	Start             []byte
+	Max               uint64
+}
+
+// Dumper walks the account set of a given block and renders it as a Dump.
+type Dumper struct {
+	db      ethdb.Database
+	blockNr uint64
+}
+
+// NewDumper creates a Dumper over db at the given block number.
+func NewDumper(db ethdb.Database, blockNr uint64) *Dumper {
+	return &Dumper{db: db, blockNr: blockNr}
+}
+
+// DefaultDump walks every account at d's block number and renders them as a
+// single, fully materialized JSON blob. It drives IterativeDump, starting
+// from the first page it already pulled to get the root, and buffers every
+// callback into the legacy Dump shape — kept around for callers that don't
+// care about memory usage on mainnet-sized databases.
+func (d *Dumper) DefaultDump() []byte {
+	dump := Dump{Accounts: make(map[string]DumpAccount)}
+
+	firstPage := d.RawDump(DumpConfig{})
+	if firstPage.Err != nil {
+		return []byte(fmt.Sprintf("error dumping state: %v", firstPage.Err))
+	}
+	dump.Root = firstPage.Root
+	for hexAddr, acc := range firstPage.Accounts {
+		dump.Accounts[hexAddr] = acc
+	}
+
+	if firstPage.Next != nil {
+		err := d.IterativeDump(DumpConfig{Start: firstPage.Next}, func(addr common.Address, acc DumpAccount) error {
+			dump.Accounts[addr.Hex()] = acc
+			return nil
+		})
+		if err != nil {
+			return []byte(fmt.Sprintf("error dumping state: %v", err))
+		}
+	}
+
+	out, err := json.MarshalIndent(dump, "", "    ")
+	if err != nil {
+		return []byte(fmt.Sprintf("error marshalling dump: %v", err))
+	}
+	return out
+}
+
+// IterativeDump walks every account matching opts at d's block number,
+// paginating through the underlying database Max accounts at a time so the
+// full state never has to be materialized in memory, and invokes onAccount
+// for each one. Walking stops as soon as onAccount returns an error, or as
+// soon as a page fails to read from the database.
+func (d *Dumper) IterativeDump(opts DumpConfig, onAccount func(addr common.Address, acc DumpAccount) error) error {
+	cursor := opts.Start
+	for {
+		page := opts
+		page.Start = cursor
+
+		dump := d.RawDump(page)
+		if dump.Err != nil {
+			return dump.Err
+		}
+		for hexAddr, acc := range dump.Accounts {
+			addr := common.HexToAddress(hexAddr)
+			if opts.OnlyWithAddresses && addr == (common.Address{}) {
+				continue
+			}
+			if err := onAccount(addr, acc); err != nil {
+				return err
+			}
+		}
+		if dump.Next == nil {
+			return nil
+		}
+		cursor = dump.Next
+	}
+}
+
+// RawDump returns a single page of the world state, starting at opts.Start
+// and containing at most opts.Max accounts (0 meaning "no limit, return
+// everything in one page"). A database failure is reported via the returned
+// IteratorDump's Err field rather than silently truncating the page.
+func (d *Dumper) RawDump(opts DumpConfig) IteratorDump {
+	dump := IteratorDump{Accounts: make(map[string]DumpAccount)}
+
+	root, accounts, next, err := d.db.WalkAccountsAtBlock(d.blockNr, opts.Start, opts.Max)
+	if err != nil {
+		dump.Err = err
+		return dump
+	}
+	dump.Root = fmt.Sprintf("%x", root)
+	dump.Next = next
+
+	for addr, acc := range accounts {
+		dumpAcc := DumpAccount{
+			Balance:  acc.Balance.String(),
+			Nonce:    acc.Nonce,
+			Root:     fmt.Sprintf("%x", acc.Root),
+			CodeHash: fmt.Sprintf("%x", acc.CodeHash),
+		}
+		if !opts.SkipCode && !acc.IsEmptyCodeHash() {
+			code, err := d.db.GetCode(acc.CodeHash)
+			if err != nil {
+				dump.Err = err
+				return dump
+			}
+			if len(code) > 0 {
+				dumpAcc.Code = fmt.Sprintf("%x", code)
+			}
+		}
+		if !opts.SkipStorage {
+			storage, err := d.db.WalkAccountStorageAtBlock(d.blockNr, addr, acc.Incarnation)
+			if err != nil {
+				dump.Err = err
+				return dump
+			}
+			if len(storage) > 0 {
+				dumpAcc.Storage = make(map[string]string, len(storage))
+				for key, value := range storage {
+					dumpAcc.Storage[key.Hex()] = value.Hex()
+				}
+			}
+		}
+		dump.Accounts[addr.Hex()] = dumpAcc
+	}
+	return dump
+}
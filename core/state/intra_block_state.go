@@ -0,0 +1,470 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+)
+
+var ripemd = common.HexToAddress("0000000000000000000000000000000000000003")
+
+// trieEmptyRoot is the known root hash of an empty trie, used to seed freshly
+// created state objects before anything has been written into their storage.
+var trieEmptyRoot = common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+
+type revision struct {
+	id           int
+	journalIndex int
+}
+
+// IntraBlockState is responsible for caching and managing state changes
+// that occur during block's execution.
+// NOT THREAD SAFE!
+type IntraBlockState struct {
+	stateReader StateReader
+
+	// This map holds 'live' objects, which will get modified while processing a state transition.
+	stateObjects      map[common.Address]*stateObject
+	stateObjectsDirty map[common.Address]struct{}
+
+	// The refund counter, also used by state transitioning.
+	refund uint64
+
+	thash, bhash common.Hash
+	txIndex      int
+	logs         map[common.Hash][]interface{}
+	logSize      uint
+
+	journal        *journal
+	validRevisions []revision
+	nextRevisionID int
+
+	// dbErr tracks the first error encountered while reading from or writing
+	// to the underlying state database. Nearly every getter below swallows the
+	// error it receives from the trie/KV layer so that callers don't have to
+	// thread an error return through every single state access; dbErr is the
+	// sink that keeps that error from being lost, and FinalizeTx/CommitBlock
+	// surface it to the caller as the final word on whether the transition
+	// succeeded.
+	dbErr error
+}
+
+// New creates a new state backed by the given StateReader.
+func New(stateReader StateReader) *IntraBlockState {
+	return &IntraBlockState{
+		stateReader:       stateReader,
+		stateObjects:      make(map[common.Address]*stateObject),
+		stateObjectsDirty: make(map[common.Address]struct{}),
+		logs:              make(map[common.Hash][]interface{}),
+		journal:           newJournal(),
+	}
+}
+
+// setError remembers the first non-nil error it is called with.
+func (sdb *IntraBlockState) setError(err error) {
+	if sdb.dbErr == nil {
+		sdb.dbErr = err
+	}
+}
+
+// Error returns the memorized database failure occurred earlier.
+func (sdb *IntraBlockState) Error() error {
+	return sdb.dbErr
+}
+
+// Reset clears out all ephemeral state objects from the state db, but keeps
+// the underlying state trie to avoid reloading data for the next operations.
+func (sdb *IntraBlockState) Reset() {
+	sdb.stateObjects = make(map[common.Address]*stateObject)
+	sdb.stateObjectsDirty = make(map[common.Address]struct{})
+	sdb.thash = common.Hash{}
+	sdb.bhash = common.Hash{}
+	sdb.txIndex = 0
+	sdb.logs = make(map[common.Hash][]interface{})
+	sdb.logSize = 0
+	sdb.clearJournalAndRefund()
+	sdb.dbErr = nil
+}
+
+func (sdb *IntraBlockState) clearJournalAndRefund() {
+	sdb.journal = newJournal()
+	sdb.validRevisions = sdb.validRevisions[:0]
+	sdb.refund = 0
+}
+
+// GetOrNewStateObject retrieves a state object or create a new state object if nil.
+func (sdb *IntraBlockState) GetOrNewStateObject(addr common.Address) *stateObject {
+	stateObject := sdb.getStateObject(addr)
+	if stateObject == nil || stateObject.deleted {
+		stateObject, _ = sdb.createObject(addr, stateObject)
+	}
+	return stateObject
+}
+
+// createObject creates a new state object. If there is an existing account with
+// the given address, it is overwritten and returned as the second return value.
+func (sdb *IntraBlockState) createObject(addr common.Address, previous *stateObject) (newobj, prev *stateObject) {
+	account := new(accounts.Account)
+	var original *accounts.Account
+	if previous == nil {
+		original = new(accounts.Account)
+	} else {
+		original = &previous.data
+	}
+	newobj = newObject(sdb, addr, account, original)
+	newobj.setNonce(0) // sets the object to dirty
+	if previous == nil {
+		sdb.journal.append(createObjectChange{account: &addr})
+	} else {
+		sdb.journal.append(resetObjectChange{prev: previous})
+	}
+	sdb.setStateObject(newobj)
+	return newobj, previous
+}
+
+// CreateAccount explicitly creates a state object. If a state object with the address
+// already exists the balance is carried over to the new account.
+//
+// CreateAccount is called during the EVM CREATE operation. The situation might arise that
+// a contract does the following:
+//
+//  1. sends funds to sha(account ++ (nonce + 1))
+//  2. tx_create(sha(account ++ nonce)) (note that this gets the address of 1)
+//
+// Carrying over the balance ensures that Ether doesn't disappear.
+func (sdb *IntraBlockState) CreateAccount(addr common.Address, contractCreation bool) {
+	previous := sdb.getStateObject(addr)
+
+	var prevInc uint64
+	if previous != nil && previous.deleted {
+		prevInc = previous.data.Incarnation
+	}
+	if !contractCreation {
+		if previous == nil {
+			prevInc = 0
+		} else {
+			prevInc = previous.data.Incarnation
+		}
+	}
+
+	newObj, prev := sdb.createObject(addr, previous)
+	if prev != nil {
+		newObj.setBalance(&prev.data.Balance)
+	}
+	newObj.data.Incarnation = prevInc
+	newObj.created = contractCreation
+}
+
+// getStateObject retrieves a state object given by the address, returning nil if
+// the object is not found or was deleted in this execution context.
+func (sdb *IntraBlockState) getStateObject(addr common.Address) (stateObject *stateObject) {
+	// Prefer 'live' objects.
+	if obj, ok := sdb.stateObjects[addr]; ok {
+		if obj.deleted {
+			return nil
+		}
+		return obj
+	}
+
+	account, err := sdb.stateReader.ReadAccountData(addr)
+	if err != nil {
+		sdb.setError(err)
+		return nil
+	}
+	if account == nil {
+		return nil
+	}
+	// Insert into the live set.
+	obj := newObject(sdb, addr, account, account)
+	sdb.setStateObject(obj)
+	return obj
+}
+
+func (sdb *IntraBlockState) setStateObject(object *stateObject) {
+	sdb.stateObjects[object.Address()] = object
+}
+
+// GetBalance retrieves the balance from the given address or 0 if object not found
+func (sdb *IntraBlockState) GetBalance(addr common.Address) *uint256.Int {
+	stateObject := sdb.getStateObject(addr)
+	if stateObject != nil {
+		return stateObject.Balance()
+	}
+	return uint256.NewInt()
+}
+
+func (sdb *IntraBlockState) GetNonce(addr common.Address) uint64 {
+	stateObject := sdb.getStateObject(addr)
+	if stateObject != nil {
+		return stateObject.Nonce()
+	}
+	return 0
+}
+
+func (sdb *IntraBlockState) GetCode(addr common.Address) []byte {
+	stateObject := sdb.getStateObject(addr)
+	if stateObject != nil {
+		return stateObject.Code()
+	}
+	return nil
+}
+
+func (sdb *IntraBlockState) GetCodeSize(addr common.Address) int {
+	stateObject := sdb.getStateObject(addr)
+	if stateObject != nil {
+		return stateObject.CodeSize()
+	}
+	return 0
+}
+
+func (sdb *IntraBlockState) GetCodeHash(addr common.Address) common.Hash {
+	stateObject := sdb.getStateObject(addr)
+	if stateObject == nil {
+		return common.Hash{}
+	}
+	return common.BytesToHash(stateObject.CodeHash())
+}
+
+// GetState retrieves a value from the given account's storage trie.
+func (sdb *IntraBlockState) GetState(addr common.Address, key *common.Hash, out *uint256.Int) {
+	stateObject := sdb.getStateObject(addr)
+	if stateObject != nil {
+		stateObject.GetState(key, out)
+	} else {
+		out.Clear()
+	}
+}
+
+// GetCommittedState retrieves a value from the given account's committed storage trie.
+func (sdb *IntraBlockState) GetCommittedState(addr common.Address, key *common.Hash, out *uint256.Int) {
+	stateObject := sdb.getStateObject(addr)
+	if stateObject != nil {
+		stateObject.GetCommittedState(key, out)
+	} else {
+		out.Clear()
+	}
+}
+
+func (sdb *IntraBlockState) HasSuicided(addr common.Address) bool {
+	stateObject := sdb.getStateObject(addr)
+	if stateObject != nil {
+		return stateObject.suicided
+	}
+	return false
+}
+
+// AddBalance adds amount to the account associated with addr.
+func (sdb *IntraBlockState) AddBalance(addr common.Address, amount *uint256.Int) {
+	stateObject := sdb.GetOrNewStateObject(addr)
+	if stateObject != nil {
+		stateObject.AddBalance(amount)
+	}
+}
+
+// SubBalance subtracts amount from the account associated with addr.
+func (sdb *IntraBlockState) SubBalance(addr common.Address, amount *uint256.Int) {
+	stateObject := sdb.GetOrNewStateObject(addr)
+	if stateObject != nil {
+		stateObject.SubBalance(amount)
+	}
+}
+
+func (sdb *IntraBlockState) SetBalance(addr common.Address, amount *uint256.Int) {
+	stateObject := sdb.GetOrNewStateObject(addr)
+	if stateObject != nil {
+		stateObject.SetBalance(amount)
+	}
+}
+
+func (sdb *IntraBlockState) SetNonce(addr common.Address, nonce uint64) {
+	stateObject := sdb.GetOrNewStateObject(addr)
+	if stateObject != nil {
+		stateObject.SetNonce(nonce)
+	}
+}
+
+func (sdb *IntraBlockState) SetCode(addr common.Address, codeHash common.Hash, code []byte) {
+	stateObject := sdb.GetOrNewStateObject(addr)
+	if stateObject != nil {
+		stateObject.SetCode(codeHash, code)
+	}
+}
+
+// SetState sets the value for a given key in the account's storage.
+func (sdb *IntraBlockState) SetState(addr common.Address, key *common.Hash, value uint256.Int) {
+	stateObject := sdb.GetOrNewStateObject(addr)
+	if stateObject != nil {
+		stateObject.SetState(key, value)
+	}
+}
+
+// SetStorage replaces the entire storage for the specified account with given
+// storage. This function should only be used for debugging.
+func (sdb *IntraBlockState) SetStorage(addr common.Address, storage map[common.Hash]uint256.Int) {
+	stateObject := sdb.GetOrNewStateObject(addr)
+	if stateObject != nil {
+		stateObject.SetStorage(storage)
+	}
+}
+
+// Suicide marks the given account as suicided.
+// This clears the account balance.
+//
+// The account's state object is still available until the state is committed,
+// getStateObject will return a non-nil account after Suicide.
+func (sdb *IntraBlockState) Suicide(addr common.Address) bool {
+	stateObject := sdb.getStateObject(addr)
+	if stateObject == nil {
+		return false
+	}
+	sdb.journal.append(suicideChange{
+		account:     &addr,
+		prev:        stateObject.suicided,
+		prevbalance: stateObject.Balance().Clone(),
+	})
+	stateObject.suicided = true
+	stateObject.setBalance(new(uint256.Int))
+	return true
+}
+
+// Snapshot returns an identifier for the current revision of the state.
+func (sdb *IntraBlockState) Snapshot() int {
+	id := sdb.nextRevisionID
+	sdb.nextRevisionID++
+	sdb.validRevisions = append(sdb.validRevisions, revision{id, sdb.journal.length()})
+	return id
+}
+
+// RevertToSnapshot reverts all state changes made since the given revision.
+func (sdb *IntraBlockState) RevertToSnapshot(revid int) {
+	// Find the snapshot in the stack of valid snapshots.
+	idx := sort.Search(len(sdb.validRevisions), func(i int) bool {
+		return sdb.validRevisions[i].id >= revid
+	})
+	if idx == len(sdb.validRevisions) || sdb.validRevisions[idx].id != revid {
+		panic(fmt.Errorf("revision id %v cannot be reverted", revid))
+	}
+	snapshot := sdb.validRevisions[idx].journalIndex
+
+	// Replay the journal to undo changes and remove invalidated snapshots
+	sdb.journal.revert(sdb, snapshot)
+	sdb.validRevisions = sdb.validRevisions[:idx]
+}
+
+// FinalizeTx should be called after every transaction.
+// It applies the changes accumulated so far to the underlying state writer, and
+// clears the per-transaction journal so the next transaction starts clean.
+func (sdb *IntraBlockState) FinalizeTx(ctx context.Context, stateWriter StateWriter) error {
+	// Only this transaction's journal-dirtied addresses need to go to
+	// stateWriter here; sdb.stateObjectsDirty accumulates separately across
+	// every FinalizeTx call in the block so CommitBlock can flush everything
+	// that changed in one pass once the block is done. Flushing the whole
+	// accumulated set on every single FinalizeTx would redo the same I/O for
+	// every earlier transaction's objects on every later one.
+	txDirty := make(map[common.Address]struct{}, len(sdb.journal.dirties))
+	for addr := range sdb.journal.dirties {
+		so, exist := sdb.stateObjects[addr]
+		if !exist {
+			continue
+		}
+		if so.suicided || (so.empty() && so.created) {
+			so.deleted = true
+		}
+		txDirty[addr] = struct{}{}
+		sdb.stateObjectsDirty[addr] = struct{}{}
+	}
+	if err := sdb.flushStateObjects(ctx, stateWriter, txDirty, false); err != nil {
+		sdb.setError(err)
+	}
+	sdb.clearJournalAndRefund()
+	return sdb.dbErr
+}
+
+// CommitBlock finalises the state and pushes every account that was dirtied
+// anywhere in the block through the given state writer, which is expected to
+// persist it into the block's database. Unlike FinalizeTx this is the final
+// word for the block: deleted objects are dropped from the live cache and
+// the dirty set is cleared so the next block starts clean.
+func (sdb *IntraBlockState) CommitBlock(ctx context.Context, stateWriter StateWriter) error {
+	if err := sdb.flushStateObjects(ctx, stateWriter, sdb.stateObjectsDirty, true); err != nil {
+		sdb.setError(err)
+	}
+	sdb.clearJournalAndRefund()
+	return sdb.dbErr
+}
+
+// flushStateObjects writes every state object named in dirty to stateWriter,
+// returning the first error it sees rather than aborting the whole flush —
+// its callers record that error into dbErr, where Error() reports it. When
+// final is set (the CommitBlock path) the per-object and block-level dirty
+// bookkeeping is retired once it's been flushed; otherwise (the FinalizeTx
+// path) it is left in place so a later CommitBlock still sees it.
+func (sdb *IntraBlockState) flushStateObjects(ctx context.Context, stateWriter StateWriter, dirty map[common.Address]struct{}, final bool) error {
+	var coalescedErr error
+	for addr := range dirty {
+		so, exist := sdb.stateObjects[addr]
+		if !exist {
+			continue
+		}
+		if so.suicided || so.deleted {
+			if err := stateWriter.DeleteAccount(ctx, addr, &so.data); err != nil && coalescedErr == nil {
+				coalescedErr = err
+			}
+			if final {
+				delete(sdb.stateObjects, addr)
+			}
+			continue
+		}
+		if so.dirtyCode {
+			if err := stateWriter.UpdateAccountCode(so.addrHash, so.data.Incarnation, so.data.CodeHash, so.code); err != nil && coalescedErr == nil {
+				coalescedErr = err
+			}
+		}
+		var original accounts.Account
+		if err := stateWriter.UpdateAccountData(ctx, addr, &original, &so.data); err != nil && coalescedErr == nil {
+			coalescedErr = err
+		}
+		for key, value := range so.dirtyStorage {
+			var original uint256.Int
+			if err := stateWriter.WriteAccountStorage(ctx, addr, so.data.Incarnation, &key, &original, &value); err != nil && coalescedErr == nil {
+				coalescedErr = err
+			}
+			if final {
+				// Whatever this slot reads as now depends entirely on what
+				// stateWriter actually did with it (a real writer persisted
+				// it, a NoopWriter discarded it) — drop the cached original
+				// rather than guess, so the next GetCommittedState call asks
+				// the StateReader instead of trusting a stale answer.
+				delete(so.originStorage, key)
+			}
+		}
+		if final {
+			so.dirtyStorage = make(map[common.Hash]uint256.Int)
+		}
+	}
+	if final {
+		sdb.stateObjectsDirty = make(map[common.Address]struct{})
+	}
+	return coalescedErr
+}
@@ -0,0 +1,59 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"context"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+)
+
+// NoopWriter is a StateWriter that discards every update. Gas estimation and
+// debug_traceCall only care about the balances/storage an execution would
+// have produced, not about actually persisting them, so handing FinalizeTx /
+// CommitBlock a NoopWriter lets the caller skip building a TrieStateWriter +
+// DbStateWriter pair (and the trie/KV I/O that comes with it) purely to throw
+// the result away.
+type NoopWriter struct{}
+
+var _ StateWriter = (*NoopWriter)(nil)
+
+// NewNoopWriter returns a NoopWriter. It carries no state, so a single value
+// can be reused across calls, but the constructor is provided for symmetry
+// with TrieStateWriter/DbStateWriter.
+func NewNoopWriter() *NoopWriter {
+	return &NoopWriter{}
+}
+
+func (*NoopWriter) UpdateAccountData(ctx context.Context, address common.Address, original, account *accounts.Account) error {
+	return nil
+}
+
+func (*NoopWriter) UpdateAccountCode(addrHash common.Hash, incarnation uint64, codeHash common.Hash, code []byte) error {
+	return nil
+}
+
+func (*NoopWriter) DeleteAccount(ctx context.Context, address common.Address, original *accounts.Account) error {
+	return nil
+}
+
+func (*NoopWriter) WriteAccountStorage(ctx context.Context, address common.Address, incarnation uint64, key *common.Hash, original, value *uint256.Int) error {
+	return nil
+}
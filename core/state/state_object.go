@@ -0,0 +1,293 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/turbo-geth/common"
+	"github.com/ledgerwatch/turbo-geth/core/types/accounts"
+	"github.com/ledgerwatch/turbo-geth/crypto"
+)
+
+var emptyCodeHash = crypto.Keccak256(nil)
+
+// stateObject represents an Ethereum account which is being modified.
+//
+// The usage pattern is as follows:
+// First you need to obtain a state object.
+// Account values can be accessed and modified through the object.
+// Finally, call FinalizeTx/CommitBlock on the owning IntraBlockState to flush
+// the modified object through a StateWriter.
+type stateObject struct {
+	address  common.Address
+	addrHash common.Hash // hash of ethereum address of the account
+	data     accounts.Account
+	db       *IntraBlockState
+
+	// Write caches.
+	code Code // contract bytecode, which gets set when code is loaded
+
+	originStorage map[common.Hash]uint256.Int // Storage cache of original entries to dedup rewrites
+	dirtyStorage  map[common.Hash]uint256.Int // Storage entries modified since the last CommitBlock (FinalizeTx keeps them)
+	fakeStorage   map[common.Hash]uint256.Int // Fake storage used for debug_traceCall overrides, set at the top of IntraBlockState only
+
+	// Cache flags.
+	dirtyCode bool // true if the code was updated
+	suicided  bool
+	deleted   bool
+	created   bool
+}
+
+// empty returns whether the account is considered empty.
+func (so *stateObject) empty() bool {
+	return so.data.Nonce == 0 && so.data.Balance.IsZero() && so.data.IsEmptyCodeHash()
+}
+
+// newObject creates a state object.
+func newObject(db *IntraBlockState, address common.Address, data, previous *accounts.Account) *stateObject {
+	var so stateObject
+	so.db = db
+	so.address = address
+	so.addrHash = crypto.Keccak256Hash(address[:])
+	so.data = *data
+	if so.data.Balance.IsZero() {
+		so.data.Balance = *new(uint256.Int)
+	}
+	if so.data.CodeHash == (common.Hash{}) {
+		so.data.CodeHash = common.BytesToHash(emptyCodeHash)
+	}
+	if so.data.Root == (common.Hash{}) {
+		so.data.Root = trieEmptyRoot
+	}
+	so.originStorage = make(map[common.Hash]uint256.Int)
+	so.dirtyStorage = make(map[common.Hash]uint256.Int)
+	return &so
+}
+
+// EncodeRLP implements rlp.Encoder.
+func (so *stateObject) EncodeRLP(w io.Writer) error {
+	return so.data.EncodeRLP(w)
+}
+
+func (so *stateObject) setIncarnation(incarnation uint64) {
+	so.data.Incarnation = incarnation
+}
+
+func (so *stateObject) touch() {
+	so.db.journal.append(touchChange{account: &so.address})
+	if so.address == ripemd {
+		// Explicitly put it in the dirty-cache, which is otherwise generated from
+		// flattened journals.
+		so.db.journal.dirty(so.address)
+	}
+}
+
+// GetState returns a value from account storage.
+func (so *stateObject) GetState(key *common.Hash, out *uint256.Int) {
+	if so.fakeStorage != nil {
+		value := so.fakeStorage[*key]
+		*out = value
+		return
+	}
+	value, dirty := so.dirtyStorage[*key]
+	if dirty {
+		*out = value
+		return
+	}
+	so.GetCommittedState(key, out)
+}
+
+// GetCommittedState retrieves a value from the committed account storage trie.
+func (so *stateObject) GetCommittedState(key *common.Hash, out *uint256.Int) {
+	if so.fakeStorage != nil {
+		*out = so.fakeStorage[*key]
+		return
+	}
+	// If we have the original value cached, return that
+	value, cached := so.originStorage[*key]
+	if cached {
+		*out = value
+		return
+	}
+	enc, err := so.getCommittedStateTrie(key)
+	if err != nil {
+		so.db.setError(err)
+		out.Clear()
+		return
+	}
+	out.SetBytes(enc)
+	so.originStorage[*key] = *out
+}
+
+// getCommittedStateTrie fetches the raw bytes of a storage slot from the
+// underlying state reader and returns any error as is; GetCommittedState
+// records it on the enclosing IntraBlockState so it is never silently dropped.
+func (so *stateObject) getCommittedStateTrie(key *common.Hash) ([]byte, error) {
+	return so.db.stateReader.ReadAccountStorage(so.address, so.data.Incarnation, key)
+}
+
+// SetState updates a value in account storage.
+func (so *stateObject) SetState(key *common.Hash, value uint256.Int) {
+	// If the fake storage is set, put the temporary state update here.
+	if so.fakeStorage != nil {
+		so.db.journal.append(fakeStorageChange{
+			account:  &so.address,
+			key:      *key,
+			prevalue: so.fakeStorage[*key],
+		})
+		so.fakeStorage[*key] = value
+		return
+	}
+	// If the new value is the same as old, don't set
+	var prev uint256.Int
+	so.GetState(key, &prev)
+	if prev == value {
+		return
+	}
+	so.db.journal.append(storageChange{
+		account:  &so.address,
+		key:      *key,
+		prevalue: prev,
+	})
+	so.setState(key, value)
+}
+
+// SetStorage replaces the entire state storage with the given one, used for debug_traceCall.
+func (so *stateObject) SetStorage(storage map[common.Hash]uint256.Int) {
+	so.fakeStorage = storage
+}
+
+func (so *stateObject) setState(key *common.Hash, value uint256.Int) {
+	so.dirtyStorage[*key] = value
+}
+
+// AddBalance adds amount to so's balance.
+func (so *stateObject) AddBalance(amount *uint256.Int) {
+	if amount.IsZero() {
+		if so.empty() {
+			so.touch()
+		}
+		return
+	}
+	var res uint256.Int
+	res.Add(&so.data.Balance, amount)
+	so.SetBalance(&res)
+}
+
+// SubBalance removes amount from so's balance.
+func (so *stateObject) SubBalance(amount *uint256.Int) {
+	if amount.IsZero() {
+		return
+	}
+	var res uint256.Int
+	res.Sub(&so.data.Balance, amount)
+	so.SetBalance(&res)
+}
+
+func (so *stateObject) SetBalance(amount *uint256.Int) {
+	so.db.journal.append(balanceChange{
+		account: &so.address,
+		prev:    so.data.Balance.Clone(),
+	})
+	so.setBalance(amount)
+}
+
+func (so *stateObject) setBalance(amount *uint256.Int) {
+	so.data.Balance = *amount
+}
+
+// Returns the address of the contract/account
+func (so *stateObject) Address() common.Address {
+	return so.address
+}
+
+func (so *stateObject) SetCode(codeHash common.Hash, code []byte) {
+	prevcode := so.Code()
+	so.db.journal.append(codeChange{
+		account:  &so.address,
+		prevhash: so.data.CodeHash[:],
+		prevcode: prevcode,
+	})
+	so.setCode(codeHash, code)
+}
+
+func (so *stateObject) setCode(codeHash common.Hash, code []byte) {
+	so.code = code
+	so.data.CodeHash = codeHash
+	so.dirtyCode = true
+}
+
+func (so *stateObject) SetNonce(nonce uint64) {
+	so.db.journal.append(nonceChange{
+		account: &so.address,
+		prev:    so.data.Nonce,
+	})
+	so.setNonce(nonce)
+}
+
+func (so *stateObject) setNonce(nonce uint64) {
+	so.data.Nonce = nonce
+}
+
+func (so *stateObject) CodeHash() []byte {
+	return so.data.CodeHash[:]
+}
+
+func (so *stateObject) Balance() *uint256.Int {
+	return &so.data.Balance
+}
+
+func (so *stateObject) Nonce() uint64 {
+	return so.data.Nonce
+}
+
+// Code returns the contract code associated with this object, if any.
+func (so *stateObject) Code() []byte {
+	if so.code != nil {
+		return so.code
+	}
+	if so.data.IsEmptyCodeHash() {
+		return nil
+	}
+	code, err := so.db.stateReader.ReadAccountCode(so.address, so.data.Incarnation, so.data.CodeHash)
+	if err != nil {
+		so.db.setError(fmt.Errorf("can't load code hash %x: %w", so.CodeHash(), err))
+	}
+	so.code = code
+	return code
+}
+
+func (so *stateObject) CodeSize() int {
+	if so.code != nil {
+		return len(so.code)
+	}
+	if so.data.IsEmptyCodeHash() {
+		return 0
+	}
+	size, err := so.db.stateReader.ReadAccountCodeSize(so.address, so.data.Incarnation, so.data.CodeHash)
+	if err != nil {
+		so.db.setError(fmt.Errorf("can't load code size %x: %w", so.CodeHash(), err))
+	}
+	return size
+}
+
+// Code is a placeholder type used only to make stateObject.code's meaning clear.
+type Code []byte
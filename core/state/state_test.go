@@ -19,6 +19,8 @@ package state
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"testing"
 
 	"github.com/holiman/uint256"
@@ -66,6 +68,7 @@ func (s *StateSuite) TestDump(c *checker.C) {
 
 	err = s.state.CommitBlock(ctx, s.tds.DbStateWriter())
 	c.Check(err, checker.IsNil)
+	c.Check(s.state.Error(), checker.IsNil)
 
 	// check that dump contains the state objects that are in trie
 	got := string(NewDumper(s.db, 1).DefaultDump())
@@ -126,6 +129,7 @@ func (s *StateSuite) TestNull(c *checker.C) {
 	if !value.IsZero() {
 		c.Errorf("expected empty hash. got %x", value)
 	}
+	c.Check(s.state.Error(), checker.IsNil)
 }
 
 func (s *StateSuite) TestSnapshot(c *checker.C) {
@@ -207,6 +211,9 @@ func TestSnapshot2(t *testing.T) {
 	if err != nil {
 		t.Fatal("error while committing state", err)
 	}
+	if state.Error() != nil {
+		t.Fatal("unexpected deferred error after committing state", state.Error())
+	}
 
 	// and one with deleted == true
 	so1 := state.getStateObject(stateobjaddr1)
@@ -344,7 +351,12 @@ func TestDump(t *testing.T) {
 
 	// check that dump contains the state objects that are in trie
 	got := string(NewDumper(db, 2).DefaultDump())
-	want := `{
+	if got != wantDump {
+		t.Fatalf("dump mismatch:\ngot: %s\nwant: %s\n", got, wantDump)
+	}
+}
+
+const wantDump = `{
     "root": "0000000000000000000000000000000000000000000000000000000000000000",
     "accounts": {
         "0x0000000000000000000000000000000000000001": {
@@ -368,7 +380,286 @@ func TestDump(t *testing.T) {
         }
     }
 }`
-	if got != want {
-		t.Fatalf("dump mismatch:\ngot: %s\nwant: %s\n", got, want)
+
+// TestDumpPaginated drives the same fixture as TestDump but through
+// IterativeDump with a page size that forces the three accounts to be
+// fetched across two RawDump pages, and checks the result is byte-for-byte
+// identical to the single-shot DefaultDump output.
+func TestDumpPaginated(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	tds := NewTrieDbState(common.Hash{}, db, 0)
+	state := New(tds)
+	tds.StartNewBuffer()
+
+	obj1 := state.GetOrNewStateObject(toAddr([]byte{0x01}))
+	obj1.AddBalance(uint256.NewInt().SetUint64(22))
+	obj2 := state.GetOrNewStateObject(toAddr([]byte{0x01, 0x02}))
+	obj2.SetCode(crypto.Keccak256Hash([]byte{3, 3, 3, 3, 3, 3, 3}), []byte{3, 3, 3, 3, 3, 3, 3})
+	obj2.setIncarnation(1)
+	obj3 := state.GetOrNewStateObject(toAddr([]byte{0x02}))
+	obj3.SetBalance(uint256.NewInt().SetUint64(44))
+
+	ctx := context.TODO()
+	if err := tds.TrieStateWriter().UpdateAccountData(ctx, obj1.address, &obj1.data, new(accounts.Account)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tds.TrieStateWriter().UpdateAccountData(ctx, obj2.address, &obj2.data, new(accounts.Account)); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+
+	tds.SetBlockNr(1)
+
+	blockWriter := tds.DbStateWriter()
+	if err := state.CommitBlock(ctx, blockWriter); err != nil {
+		t.Fatal(err)
+	}
+	if err := blockWriter.WriteChangeSets(); err != nil {
+		t.Fatal(err)
+	}
+	if err := blockWriter.WriteHistory(); err != nil {
+		t.Fatal(err)
+	}
+
+	dumper := NewDumper(db, 2)
+
+	// sanity check that pagination actually kicked in rather than the whole
+	// set coming back in a single RawDump call
+	firstPage := dumper.RawDump(DumpConfig{Max: 2})
+	if len(firstPage.Accounts) >= 3 {
+		t.Fatalf("expected RawDump with Max=2 to page, got %d accounts in one page", len(firstPage.Accounts))
+	}
+	if firstPage.Next == nil {
+		t.Fatal("expected RawDump with Max=2 to report a Next cursor for the second page")
+	}
+
+	dump := Dump{
+		Root:     firstPage.Root,
+		Accounts: make(map[string]DumpAccount),
+	}
+	err := dumper.IterativeDump(DumpConfig{Max: 2}, func(addr common.Address, acc DumpAccount) error {
+		dump.Accounts[addr.Hex()] = acc
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := json.MarshalIndent(dump, "", "    ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != wantDump {
+		t.Fatalf("paginated dump mismatch:\ngot: %s\nwant: %s\n", out, wantDump)
+	}
+}
+
+// fakeOdrFetcher backs an OdrStateReader the way a light client's network
+// layer would: every read is served out of a fixed local map, standing in
+// for a remote peer that is always reachable and never returns garbage.
+type fakeOdrFetcher struct {
+	accounts map[common.Address]*accounts.Account
+	storage  map[common.Address]map[common.Hash][]byte
+	code     map[common.Hash][]byte
+}
+
+func newFakeOdrFetcher() *fakeOdrFetcher {
+	return &fakeOdrFetcher{
+		accounts: make(map[common.Address]*accounts.Account),
+		storage:  make(map[common.Address]map[common.Hash][]byte),
+		code:     make(map[common.Hash][]byte),
+	}
+}
+
+func (f *fakeOdrFetcher) FetchAccount(address common.Address) (*accounts.Account, error) {
+	if account, ok := f.accounts[address]; ok {
+		return account, nil
+	}
+	return new(accounts.Account), nil
+}
+
+func (f *fakeOdrFetcher) FetchStorage(address common.Address, incarnation uint64, key common.Hash) ([]byte, error) {
+	if perAccount, ok := f.storage[address]; ok {
+		return perAccount[key], nil
+	}
+	return nil, nil
+}
+
+func (f *fakeOdrFetcher) FetchCode(address common.Address, incarnation uint64, codeHash common.Hash) ([]byte, error) {
+	return f.code[codeHash], nil
+}
+
+// TestSnapshot2Odr reuses the TestSnapshot2 fixtures through an
+// IntraBlockState backed by OdrStateReader instead of TrieDbState, and checks
+// that reverting a snapshot restores so0's balance and storage. Unlike
+// TestSnapshot2 it commits nothing and does not cover a deleted object.
+func TestSnapshot2Odr(t *testing.T) {
+	fetcher := newFakeOdrFetcher()
+	reader := NewOdrStateReader(fetcher)
+	state := New(reader)
+
+	stateobjaddr0 := toAddr([]byte("so0"))
+	stateobjaddr1 := toAddr([]byte("so1"))
+	var storageaddr common.Hash
+
+	data0 := uint256.NewInt().SetUint64(17)
+	data1 := uint256.NewInt().SetUint64(18)
+
+	state.SetState(stateobjaddr0, &storageaddr, *data0)
+	state.SetState(stateobjaddr1, &storageaddr, *data1)
+
+	so0 := state.getStateObject(stateobjaddr0)
+	so0.SetBalance(uint256.NewInt().SetUint64(42))
+	so0.SetNonce(43)
+	so0.SetCode(crypto.Keccak256Hash([]byte{'c', 'a', 'f', 'e'}), []byte{'c', 'a', 'f', 'e'})
+	state.setStateObject(so0)
+
+	snapshot := state.Snapshot()
+
+	so0.SetBalance(uint256.NewInt().SetUint64(99))
+	var changed uint256.Int
+	state.GetState(stateobjaddr0, &storageaddr, &changed)
+
+	state.RevertToSnapshot(snapshot)
+
+	so0Restored := state.getStateObject(stateobjaddr0)
+	if so0Restored.Balance().Cmp(uint256.NewInt().SetUint64(42)) != 0 {
+		t.Fatalf("balance mismatch after revert: have %v, want 42", so0Restored.Balance())
+	}
+	var restored uint256.Int
+	state.GetState(stateobjaddr0, &storageaddr, &restored)
+	if restored.Cmp(data0) != 0 {
+		t.Fatalf("storage mismatch after revert: have %v, want %v", restored, data0)
+	}
+	if state.Error() != nil {
+		t.Fatalf("unexpected error from OdrStateReader-backed state: %v", state.Error())
+	}
+}
+
+// TestNoopWriterLeavesDbUntouched reuses the TestSnapshot2 fixture to show
+// that running a transaction against a NoopWriter leaves the committed DB
+// state exactly as it was, while the mutation is still visible through
+// GetState until the caller reverts.
+func TestNoopWriterLeavesDbUntouched(t *testing.T) {
+	db := ethdb.NewMemDatabase()
+	ctx := context.TODO()
+	tds := NewTrieDbState(common.Hash{}, db, 0)
+	state := New(tds)
+	tds.StartNewBuffer()
+
+	stateobjaddr := toAddr([]byte("so0"))
+	var storageaddr common.Hash
+	committed := uint256.NewInt().SetUint64(17)
+
+	// Commit an initial value for real, so there is a baseline to compare against.
+	state.SetState(stateobjaddr, &storageaddr, *committed)
+	if err := state.FinalizeTx(ctx, tds.TrieStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tds.ComputeTrieRoots(); err != nil {
+		t.Fatal(err)
+	}
+	tds.SetBlockNr(1)
+	if err := state.CommitBlock(ctx, tds.DbStateWriter()); err != nil {
+		t.Fatal(err)
+	}
+
+	rootAfterRealCommit := tds.LastRoot()
+
+	// Observe-only: mutate under a NoopWriter and read it back without ever
+	// hitting ComputeTrieRoots or the DB.
+	observeOnly := uint256.NewInt().SetUint64(99)
+	state.SetState(stateobjaddr, &storageaddr, *observeOnly)
+
+	var seen uint256.Int
+	state.GetState(stateobjaddr, &storageaddr, &seen)
+	if seen.Cmp(observeOnly) != 0 {
+		t.Fatalf("expected the observe-only write to be visible via GetState, have %v want %v", seen, observeOnly)
+	}
+
+	if err := state.FinalizeTx(ctx, NewNoopWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.CommitBlock(ctx, NewNoopWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if state.Error() != nil {
+		t.Fatalf("unexpected error from NoopWriter: %v", state.Error())
+	}
+
+	if tds.LastRoot() != rootAfterRealCommit {
+		t.Fatalf("NoopWriter path must not move the committed root: have %x, want %x", tds.LastRoot(), rootAfterRealCommit)
+	}
+
+	var committedNow uint256.Int
+	state.GetCommittedState(stateobjaddr, &storageaddr, &committedNow)
+	if committedNow.Cmp(committed) != 0 {
+		t.Fatalf("NoopWriter must not change committed state: have %v, want %v", committedNow, committed)
+	}
+
+	// Separately: a pending mutation is still visible via GetState right up
+	// until the caller reverts it, same as any other snapshot/revert pair —
+	// NoopWriter doesn't change that contract.
+	snapshot := state.Snapshot()
+	pending := uint256.NewInt().SetUint64(123)
+	state.SetState(stateobjaddr, &storageaddr, *pending)
+
+	var seenPending uint256.Int
+	state.GetState(stateobjaddr, &storageaddr, &seenPending)
+	if seenPending.Cmp(pending) != 0 {
+		t.Fatalf("expected the pending write to be visible via GetState, have %v want %v", seenPending, pending)
+	}
+
+	state.RevertToSnapshot(snapshot)
+	var afterRevert uint256.Int
+	state.GetState(stateobjaddr, &storageaddr, &afterRevert)
+	if afterRevert.Cmp(committed) != 0 {
+		t.Fatalf("expected revert to restore the committed value, have %v want %v", afterRevert, committed)
+	}
+}
+
+// failingStorageDatabase wraps a working ethdb.Database but fails every
+// storage read, so tests can exercise the dbErr plumbing without a real
+// corrupted trie.
+type failingStorageDatabase struct {
+	ethdb.Database
+	err error
+}
+
+func (f *failingStorageDatabase) GetStorage(address common.Address, incarnation uint64, key common.Hash) ([]byte, error) {
+	return nil, f.err
+}
+
+// TestErrorSurfacesFromFailingDatabase verifies that a read failure in the
+// underlying database is not silently swallowed: it must be recorded by
+// IntraBlockState and returned from Error() instead of being lost.
+func TestErrorSurfacesFromFailingDatabase(t *testing.T) {
+	injected := errors.New("injected ethdb failure")
+	db := &failingStorageDatabase{Database: ethdb.NewMemDatabase(), err: injected}
+	tds := NewTrieDbState(common.Hash{}, db, 0)
+	state := New(tds)
+	tds.StartNewBuffer()
+
+	addr := toAddr([]byte("broken"))
+	var key common.Hash
+	var value uint256.Int
+
+	// GetCommittedState on an address with no account returns early after
+	// the account lookup, without reading storage from the StateReader, so
+	// the storage read (and the injected failure behind it) has to be forced
+	// by materializing the account first.
+	state.GetOrNewStateObject(addr)
+	state.GetCommittedState(addr, &key, &value)
+
+	if state.Error() == nil {
+		t.Fatal("expected Error() to surface the injected ethdb failure, got nil")
+	}
+	if !errors.Is(state.Error(), injected) {
+		t.Fatalf("expected Error() to wrap %v, got %v", injected, state.Error())
 	}
 }